@@ -0,0 +1,646 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/params/confp"
+	"github.com/ethereum/go-ethereum/params/types/ctypes"
+	"github.com/ethereum/go-ethereum/params/types/genesisT"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var errGenesisNoConfig = errors.New("genesis has no chain configuration")
+
+// gaDeriveHash derives the state root of the given genesis allocation, which
+// is used to key the genesis state in the database so that identical
+// allocations are stored (and looked up) only once.
+//
+// It does so by committing ga to a throwaway, in-memory state database via
+// flushAlloc, the same path GenesisToBlock uses to compute a genesis block's
+// real state root; an account's balance, code, nonce, storage and
+// AssetBalances are all part of the trie that root commits to. A naive
+// RLP-encode of genesisT.GenesisAccount would not work here: the type's
+// Storage and AssetBalances fields are maps, and the rlp package cannot
+// encode maps at all.
+func gaDeriveHash(ga *genesisT.GenesisAlloc) (common.Hash, error) {
+	db := rawdb.NewMemoryDatabase()
+	return flushAlloc(ga, db, false)
+}
+
+// flushAlloc commits the given genesis allocation into the provided state
+// trie database, returning the resulting state root. When usePreimages is
+// set, the preimages of the account address hashes and storage-slot hashes
+// touched by the allocation are recorded in db, so that they can later
+// be resolved by debug_storageRangeAt-style RPCs and archival exports; this
+// also registers a second preimage per AssetBalances entry (see
+// assetBalanceSlot) so that DumpGenesisAlloc can recover the original asset
+// id from the slot, rather than seeing an opaque storage entry.
+//
+// It is an error for an account's Storage map to contain a key that
+// collides with one of its own AssetBalances' derived slots: AssetBalances
+// are stored as reserved slots within the account's existing storage trie
+// (see assetBalanceSlot) rather than in a trie of their own, so they
+// necessarily share that trie's key space with Storage. Rather than letting
+// one silently clobber the other, flushAlloc rejects any account whose
+// Storage map claims the slot derived for one of its own AssetBalances.
+func flushAlloc(ga *genesisT.GenesisAlloc, db ethdb.Database, usePreimages bool) (common.Hash, error) {
+	// Preimages are only actually retained by the trie database if its
+	// config says so; passing usePreimages through here, rather than a nil
+	// config, is what makes the InsertPreimage call below (and UsePreimages
+	// on the Genesis) do anything at all.
+	statedb, err := state.New(common.Hash{}, state.NewDatabaseWithConfig(db, &trie.Config{Preimages: usePreimages}), nil)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	preimages := make(map[common.Hash][]byte)
+	for addr, account := range *ga {
+		statedb.AddBalance(addr, account.Balance)
+		statedb.SetCode(addr, account.Code)
+		statedb.SetNonce(addr, account.Nonce)
+		for key, value := range account.Storage {
+			statedb.SetState(addr, key, value)
+		}
+		for assetID, balance := range account.AssetBalances {
+			slot := assetBalanceSlot(assetID)
+			if _, collide := account.Storage[slot]; collide {
+				return common.Hash{}, fmt.Errorf("genesis account %s: Storage key %s collides with the reserved asset-balance slot for asset %s", addr, slot, assetID)
+			}
+			statedb.SetState(addr, slot, common.BigToHash(balance))
+		}
+		if usePreimages {
+			preimages[crypto.Keccak256Hash(addr.Bytes())] = common.CopyBytes(addr.Bytes())
+			for key := range account.Storage {
+				preimages[crypto.Keccak256Hash(key.Bytes())] = common.CopyBytes(key.Bytes())
+			}
+			for assetID := range account.AssetBalances {
+				slot := assetBalanceSlot(assetID)
+				preimages[crypto.Keccak256Hash(slot.Bytes())] = common.CopyBytes(slot.Bytes())
+				preimages[slot] = encodeAssetBalanceSlotPreimage(assetID)
+			}
+		}
+	}
+	if usePreimages && len(preimages) > 0 {
+		statedb.Database().TrieDB().InsertPreimage(preimages)
+	}
+	root, err := statedb.Commit(false)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	err = statedb.Database().TrieDB().Commit(root, true, nil)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return root, nil
+}
+
+// assetBalanceSlotPrefix namespaces the storage slots used to hold the
+// AssetBalances of a genesis account, keeping them out of the key space an
+// account's regular Storage allocation uses.
+var assetBalanceSlotPrefix = []byte("core/genesis: asset-balance/")
+
+// assetBalanceSlot derives the storage slot a given asset id's balance is
+// written to within an account's storage trie. Genesis multi-asset balances
+// are stored as reserved slots in the account's existing storage trie,
+// namespaced by assetBalanceSlotPrefix, rather than in a dedicated sub-trie
+// keyed by asset id: a true per-asset sub-trie would need its own root
+// alongside the account's storage root, which means changing the on-disk
+// account schema itself, a much larger change than this package's allocation
+// layer can make on its own. The reserved-slot scheme is the intended
+// storage layout for genesis AssetBalances.
+//
+// Because assetBalanceSlot(assetID) is itself the Keccak256Hash of
+// assetBalanceSlotPrefix and assetID, it is also a valid preimage target:
+// flushAlloc additionally registers the preimage of the slot value itself
+// (see encodeAssetBalanceSlotPreimage), so DumpGenesisAlloc can tell an
+// asset-balance slot apart from ordinary Storage and recover its asset id,
+// rather than losing that distinction across a dump/reload round trip.
+func assetBalanceSlot(assetID common.Hash) common.Hash {
+	return crypto.Keccak256Hash(assetBalanceSlotPrefix, assetID.Bytes())
+}
+
+// encodeAssetBalanceSlotPreimage builds the preimage of assetBalanceSlot(assetID),
+// i.e. the bytes whose Keccak256Hash equals the slot itself.
+func encodeAssetBalanceSlotPreimage(assetID common.Hash) []byte {
+	return append(common.CopyBytes(assetBalanceSlotPrefix), assetID.Bytes()...)
+}
+
+// decodeAssetBalanceSlotPreimage is the inverse of encodeAssetBalanceSlotPreimage:
+// given the preimage of a storage slot, it reports whether that slot was
+// derived by assetBalanceSlot and, if so, the asset id it was derived from.
+func decodeAssetBalanceSlotPreimage(data []byte) (common.Hash, bool) {
+	if len(data) != len(assetBalanceSlotPrefix)+common.HashLength || !bytes.HasPrefix(data, assetBalanceSlotPrefix) {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(data[len(assetBalanceSlotPrefix):]), true
+}
+
+// genesisHeader builds the genesis block header for g, given the already
+// computed state root.
+func genesisHeader(g *genesisT.Genesis, root common.Hash) *types.Header {
+	head := &types.Header{
+		Number:     new(big.Int).SetUint64(g.Number),
+		Nonce:      types.EncodeNonce(g.Nonce),
+		Time:       g.Timestamp,
+		ParentHash: g.ParentHash,
+		Extra:      g.ExtraData,
+		GasLimit:   g.GasLimit,
+		GasUsed:    g.GasUsed,
+		BaseFee:    g.BaseFee,
+		Difficulty: g.Difficulty,
+		MixDigest:  g.Mixhash,
+		Coinbase:   g.Coinbase,
+		Root:       root,
+	}
+	if g.GasLimit == 0 {
+		head.GasLimit = params.GenesisGasLimit
+	}
+	if g.Difficulty == nil {
+		head.Difficulty = params.GenesisDifficulty
+	}
+	if g.Config != nil && g.Config.GetEIP1559Transition() != nil && *g.Config.GetEIP1559Transition() == 0 {
+		if g.BaseFee != nil {
+			head.BaseFee = g.BaseFee
+		} else {
+			head.BaseFee = new(big.Int).SetUint64(params.InitialBaseFee)
+		}
+	}
+	return head
+}
+
+// GenesisToBlock creates the genesis block and writes state of a genesis specification
+// to the given database (or discards it if nil).
+func GenesisToBlock(g *genesisT.Genesis, db ethdb.Database) *types.Block {
+	if db == nil {
+		db = rawdb.NewMemoryDatabase()
+	}
+	root, err := flushAlloc(&g.Alloc, db, g.UsePreimages)
+	if err != nil {
+		panic(err)
+	}
+	return types.NewBlock(genesisHeader(g, root), nil, nil, nil, trie.NewStackTrie(nil))
+}
+
+// CommitGenesis writes the block and state of a genesis specification to the database.
+// The block is committed as the canonical head block.
+func CommitGenesis(g *genesisT.Genesis, db ethdb.Database, triedb *trie.Database) (*types.Block, error) {
+	block := GenesisToBlock(g, db)
+	if block.Number().Sign() != 0 {
+		return nil, errors.New("can't commit genesis block with number > 0")
+	}
+	config := g.Config
+	if config == nil {
+		config = params.AllEthashProtocolChanges
+	}
+	if err := confp.IsValid(nil, config); err != nil {
+		return nil, err
+	}
+	rawdb.WriteTd(db, block.Hash(), block.NumberU64(), block.Difficulty())
+	rawdb.WriteBlock(db, block)
+	rawdb.WriteReceipts(db, block.Hash(), block.NumberU64(), nil)
+	rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+	rawdb.WriteHeadBlockHash(db, block.Hash())
+	rawdb.WriteHeadFastBlockHash(db, block.Hash())
+	rawdb.WriteHeadHeaderHash(db, block.Hash())
+	rawdb.WriteChainConfig(db, block.Hash(), config)
+	return block, nil
+}
+
+// MustCommitGenesis writes the genesis block and state to db, panicking on error.
+// The block is committed as the canonical head block.
+func MustCommitGenesis(db ethdb.Database, g *genesisT.Genesis) *types.Block {
+	block, err := CommitGenesis(g, db, trie.NewDatabase(db))
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// SetupGenesisBlock writes or updates the genesis block in db.
+// The block that will be used is:
+//
+//	                     genesis == nil       genesis != nil
+//	                  +------------------------------------------
+//	db has no genesis |  main-net default  |  genesis
+//	db has genesis    |  from DB           |  genesis (if compatible)
+//
+// The stored chain configuration will be updated if it is compatible (i.e. does not
+// specify a fork block below the local head block, and does not walk back a merge
+// transition the stored chain has already crossed via TerminalTotalDifficulty). In
+// case of a conflict, the error is a *confp.ConfigCompatError and the new, unwritten
+// config is returned.
+//
+// Note on scope: SetupGenesisBlock only detects a TTD-crossing incompatibility
+// from what is already on disk (canonical headers and their cumulative
+// difficulty, via checkCompatibleTTD); it does not select or wire up a
+// consensus engine. Picking a beacon/PoS engine once a chain crosses its
+// TerminalTotalDifficulty is NewBlockChain's job, not genesis setup's.
+//
+// The returned chain configuration is never nil.
+func SetupGenesisBlock(db ethdb.Database, triedb *trie.Database, genesis *genesisT.Genesis) (ctypes.ChainConfigurator, common.Hash, error) {
+	if genesis != nil && genesis.Config == nil {
+		return params.AllEthashProtocolChanges, common.Hash{}, errGenesisNoConfig
+	}
+	// Just commit the new block if there is no stored genesis block.
+	stored := rawdb.ReadCanonicalHash(db, 0)
+	if (stored == common.Hash{}) {
+		if genesis == nil {
+			log.Info("Writing default main-net genesis block")
+			genesis = params.DefaultGenesisBlock()
+		} else {
+			log.Info("Writing custom genesis block")
+		}
+		block, err := CommitGenesis(genesis, db, triedb)
+		if err != nil {
+			return genesis.Config, common.Hash{}, err
+		}
+		return genesis.Config, block.Hash(), nil
+	}
+	// We have the genesis block in database(perhaps in ancient database)
+	// but the corresponding state is missing.
+	header := rawdb.ReadHeader(db, stored, 0)
+
+	// Check whether the genesis block is already written.
+	if genesis != nil {
+		hash := GenesisToBlock(genesis, nil).Hash()
+		if hash != stored {
+			return genesis.Config, hash, &genesisT.GenesisMismatchError{Stored: stored, New: hash}
+		}
+	}
+	// Get the existing chain configuration.
+	newcfg := configOrDefault(genesis, stored)
+	storedcfg := rawdb.ReadChainConfig(db, stored)
+	if storedcfg == nil {
+		log.Warn("Found genesis block without chain config")
+		rawdb.WriteChainConfig(db, stored, newcfg)
+		return newcfg, stored, nil
+	}
+	storedData, _ := json.Marshal(storedcfg)
+	// Special case: if a private network is being used (no genesis and also no
+	// mainnet hash in the database), we must not apply the `configOrDefault`
+	// chain config as that would be AllProtocolChanges (applying any new fork
+	// on top of an existing private network genesis block). In that case,
+	// only apply the overrides.
+	if genesis == nil && stored != params.MainnetGenesisHash {
+		newcfg = storedcfg
+	}
+	// Check config compatibility and write the config. Compatibility errors
+	// are returned to the caller unless we're already at block zero.
+	height := rawdb.ReadHeaderNumber(db, rawdb.ReadHeadHeaderHash(db))
+	if height == nil {
+		return newcfg, stored, fmt.Errorf("missing block number for head header hash")
+	}
+	if compatErr := confp.Compatible(header.Number, storedcfg, newcfg); compatErr != nil {
+		if *height != 0 && compatErr.RewindToBlock != 0 {
+			return newcfg, stored, compatErr
+		}
+	} else if ttdErr := checkCompatibleTTD(db, storedcfg, newcfg, *height); ttdErr != nil {
+		// Unlike fork-based errors, a TTD transition can occur as early as
+		// block 1 (giving RewindToBlock == 0), so a TTD incompatibility is
+		// gated on the chain having advanced past genesis, not on whether a
+		// rewind is required.
+		if *height != 0 {
+			return newcfg, stored, ttdErr
+		}
+	}
+	newData, _ := json.Marshal(newcfg)
+	if !bytes.Equal(newData, storedData) {
+		rawdb.WriteChainConfig(db, stored, newcfg)
+	}
+	return newcfg, stored, nil
+}
+
+// configOrDefault returns the existing genesis block's configuration, if
+// the genesis is nil, or the chain config carried by genesis otherwise.
+func configOrDefault(g *genesisT.Genesis, genesisHash common.Hash) ctypes.ChainConfigurator {
+	switch {
+	case g != nil:
+		return g.Config
+	case genesisHash == params.MainnetGenesisHash:
+		return params.MainnetChainConfig
+	default:
+		return params.AllEthashProtocolChanges
+	}
+}
+
+// checkCompatibleTTD reports an incompatibility if storedcfg has already
+// crossed its configured TerminalTotalDifficulty on the canonical chain, but
+// newcfg lowers, removes, or otherwise walks the transition back. It returns
+// nil if the stored chain never configured a TTD, or hasn't reached it yet
+// (in which case raising or introducing a TTD in newcfg is a forward-compatible
+// upgrade that confp.Compatible's ordinary fork-order checks already cover).
+//
+// The StoredBlock of the returned error is the first header on the canonical
+// chain whose cumulative difficulty exceeded the stored TTD.
+func checkCompatibleTTD(db ethdb.Database, storedcfg, newcfg ctypes.ChainConfigurator, headNumber uint64) *confp.ConfigCompatError {
+	storedTTD := storedcfg.GetEthashTerminalTotalDifficulty()
+	if storedTTD == nil {
+		return nil
+	}
+	transition := findTTDTransition(db, storedTTD, headNumber)
+	if transition == nil {
+		// The canonical chain hasn't crossed the stored TTD yet.
+		return nil
+	}
+	newTTD := newcfg.GetEthashTerminalTotalDifficulty()
+	if newTTD != nil && newTTD.Cmp(storedTTD) >= 0 {
+		// Raising (or leaving unchanged) the TTD is only a compatible change
+		// if the canonical chain's frozen, post-merge total difficulty still
+		// reaches the new threshold. Once a chain is past its merge point its
+		// blocks stop accumulating difficulty, so a higher TTD that the
+		// chain never actually reaches would retroactively make an
+		// already-merged chain appear un-merged.
+		if findTTDTransition(db, newTTD, headNumber) != nil {
+			return nil
+		}
+	}
+	rewindTo := uint64(0)
+	if transition.Sign() > 0 {
+		rewindTo = transition.Uint64() - 1
+	}
+	return &confp.ConfigCompatError{
+		What:          "terminal total difficulty",
+		StoredBlock:   transition,
+		NewBlock:      newTTD,
+		RewindToBlock: rewindTo,
+	}
+}
+
+// findTTDTransition walks the canonical chain from headNumber down to zero,
+// looking for the first (lowest) block whose cumulative total difficulty
+// exceeds ttd. It returns nil if no such block exists on the chain yet.
+func findTTDTransition(db ethdb.Database, ttd *big.Int, headNumber uint64) *big.Int {
+	var transition *big.Int
+	for i := headNumber; ; i-- {
+		hash := rawdb.ReadCanonicalHash(db, i)
+		if hash == (common.Hash{}) {
+			break
+		}
+		td := rawdb.ReadTd(db, hash, i)
+		if td == nil {
+			break
+		}
+		if td.Cmp(ttd) > 0 {
+			transition = new(big.Int).SetUint64(i)
+		} else {
+			break
+		}
+		if i == 0 {
+			break
+		}
+	}
+	return transition
+}
+
+// genesisAllocRecord is the newline-delimited JSON representation of a
+// single genesis account, as produced by DumpGenesisAlloc and consumed by
+// LoadGenesisAlloc / SetupGenesisBlockStreaming.
+type genesisAllocRecord struct {
+	Address       common.Address               `json:"address"`
+	Balance       *hexutil.Big                 `json:"balance"`
+	Nonce         hexutil.Uint64               `json:"nonce,omitempty"`
+	Code          hexutil.Bytes                `json:"code,omitempty"`
+	Storage       map[common.Hash]common.Hash  `json:"storage,omitempty"`
+	AssetBalances map[common.Hash]*hexutil.Big `json:"assetBalances,omitempty"`
+}
+
+// DumpGenesisAlloc streams the account allocation committed to the genesis
+// state trie rooted at hash to w as newline-delimited JSON, one record per
+// account, without ever materializing the full allocation in memory. This is
+// intended for exporting post-merge/mainnet-fork genesis files with millions
+// of accounts.
+//
+// Addresses are recovered from the preimages of the trie leaf keys, so the
+// genesis this is dumped from must have been committed with UsePreimages set
+// (see GenesisToBlock); otherwise DumpGenesisAlloc returns an error. Storage
+// slots derived by assetBalanceSlot are recognized via their own preimage
+// and written back out under AssetBalances rather than Storage, so an
+// account combining AssetBalances with UsePreimages round-trips through
+// DumpGenesisAlloc / LoadGenesisAlloc without losing that distinction.
+func DumpGenesisAlloc(db ethdb.Database, hash common.Hash, w io.Writer) error {
+	triedb := trie.NewDatabase(db)
+	accTrie, err := trie.NewSecure(hash, triedb)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	it := trie.NewIterator(accTrie.NodeIterator(nil))
+	for it.Next() {
+		addrBytes := rawdb.ReadPreimage(db, common.BytesToHash(it.Key))
+		if len(addrBytes) != common.AddressLength {
+			return fmt.Errorf("cannot resolve address for trie key %x: was the genesis committed with UsePreimages?", it.Key)
+		}
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(it.Value, &acc); err != nil {
+			return err
+		}
+		rec := genesisAllocRecord{
+			Address: common.BytesToAddress(addrBytes),
+			Balance: (*hexutil.Big)(acc.Balance),
+			Nonce:   hexutil.Uint64(acc.Nonce),
+		}
+		if len(acc.CodeHash) > 0 && !bytes.Equal(acc.CodeHash, types.EmptyCodeHash.Bytes()) {
+			rec.Code = rawdb.ReadCode(db, common.BytesToHash(acc.CodeHash))
+		}
+		if acc.Root != (common.Hash{}) && acc.Root != types.EmptyRootHash {
+			storageTrie, err := trie.NewSecure(acc.Root, triedb)
+			if err != nil {
+				return err
+			}
+			sit := trie.NewIterator(storageTrie.NodeIterator(nil))
+			for sit.Next() {
+				slotBytes := rawdb.ReadPreimage(db, common.BytesToHash(sit.Key))
+				if len(slotBytes) != common.HashLength {
+					return fmt.Errorf("cannot resolve storage slot for trie key %x: was the genesis committed with UsePreimages?", sit.Key)
+				}
+				slot := common.BytesToHash(slotBytes)
+				_, content, _, err := rlp.Split(sit.Value)
+				if err != nil {
+					return err
+				}
+				if assetID, ok := decodeAssetBalanceSlotPreimage(rawdb.ReadPreimage(db, slot)); ok {
+					if rec.AssetBalances == nil {
+						rec.AssetBalances = make(map[common.Hash]*hexutil.Big)
+					}
+					rec.AssetBalances[assetID] = (*hexutil.Big)(new(big.Int).SetBytes(content))
+					continue
+				}
+				if rec.Storage == nil {
+					rec.Storage = make(map[common.Hash]common.Hash)
+				}
+				rec.Storage[slot] = common.BytesToHash(content)
+			}
+			if sit.Err != nil {
+				return sit.Err
+			}
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return it.Err
+}
+
+// LoadGenesisAlloc reads a newline-delimited JSON genesis allocation, as
+// produced by DumpGenesisAlloc, and returns it as a *genesisT.Genesis with
+// Alloc populated and no other fields set. Callers that need a full genesis
+// spec (chain config, header overrides, ...) should set those fields on the
+// returned value; callers that want to avoid materializing the allocation
+// entirely should use SetupGenesisBlockStreaming instead.
+func LoadGenesisAlloc(r io.Reader) (*genesisT.Genesis, error) {
+	g := &genesisT.Genesis{Alloc: make(genesisT.GenesisAlloc)}
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var rec genesisAllocRecord
+		if err := dec.Decode(&rec); err != nil {
+			return nil, err
+		}
+		account := genesisT.GenesisAccount{
+			Balance: (*big.Int)(rec.Balance),
+			Nonce:   uint64(rec.Nonce),
+			Code:    rec.Code,
+			Storage: rec.Storage,
+		}
+		if rec.AssetBalances != nil {
+			account.AssetBalances = make(map[common.Hash]*big.Int, len(rec.AssetBalances))
+			for assetID, balance := range rec.AssetBalances {
+				account.AssetBalances[assetID] = (*big.Int)(balance)
+			}
+		}
+		g.Alloc[rec.Address] = account
+	}
+	return g, nil
+}
+
+// genesisStreamBatchSize bounds how many accounts SetupGenesisBlockStreaming
+// accumulates as dirty state objects before committing them to the trie and
+// starting a fresh state rooted at the result. It is the knob that keeps
+// peak memory bounded rather than proportional to the number of accounts in
+// the allocation. It is a var, not a const, so tests can shrink it to force
+// multiple batches without constructing a multi-million-account fixture.
+var genesisStreamBatchSize = 10000
+
+// genesisStreamBatchCommitHook, if non-nil, is invoked once per batch commit
+// performed by SetupGenesisBlockStreaming (including the final, partial
+// batch). It exists only so tests can verify that batching actually happens
+// rather than relying solely on the resulting state root, which a
+// non-batching implementation would reproduce identically.
+var genesisStreamBatchCommitHook func()
+
+// SetupGenesisBlockStreaming is the streaming counterpart to SetupGenesisBlock
+// for a genesis whose allocation is supplied as newline-delimited JSON (see
+// DumpGenesisAlloc) rather than as an in-memory genesisT.GenesisAlloc. Accounts
+// are decoded and written into the state trie in batches of
+// genesisStreamBatchSize, with each batch committed and flushed to db (through
+// a state database of its own; the triedb argument is not used) before the
+// next one starts, so a genesis file with millions of accounts
+// never needs more than one batch's worth of dirty state objects resident in
+// memory at a time.
+//
+// genesis must carry the chain configuration and any header overrides, but
+// its Alloc field is ignored in favor of the records read from r.
+func SetupGenesisBlockStreaming(db ethdb.Database, triedb *trie.Database, genesis *genesisT.Genesis, r io.Reader) (ctypes.ChainConfigurator, common.Hash, error) {
+	if genesis == nil || genesis.Config == nil {
+		return params.AllEthashProtocolChanges, common.Hash{}, errGenesisNoConfig
+	}
+	sdb := state.NewDatabaseWithConfig(db, nil)
+	statedb, err := state.New(common.Hash{}, sdb, nil)
+	if err != nil {
+		return genesis.Config, common.Hash{}, err
+	}
+	commitBatch := func() (common.Hash, error) {
+		root, err := statedb.Commit(false)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if err := sdb.TrieDB().Commit(root, true, nil); err != nil {
+			return common.Hash{}, err
+		}
+		if genesisStreamBatchCommitHook != nil {
+			genesisStreamBatchCommitHook()
+		}
+		return root, nil
+	}
+
+	dec := json.NewDecoder(r)
+	var (
+		root  common.Hash
+		count int
+	)
+	for dec.More() {
+		var rec genesisAllocRecord
+		if err := dec.Decode(&rec); err != nil {
+			return genesis.Config, common.Hash{}, err
+		}
+		statedb.AddBalance(rec.Address, (*big.Int)(rec.Balance))
+		statedb.SetNonce(rec.Address, uint64(rec.Nonce))
+		statedb.SetCode(rec.Address, rec.Code)
+		for key, value := range rec.Storage {
+			statedb.SetState(rec.Address, key, value)
+		}
+		for assetID, balance := range rec.AssetBalances {
+			slot := assetBalanceSlot(assetID)
+			if _, collide := rec.Storage[slot]; collide {
+				return genesis.Config, common.Hash{}, fmt.Errorf("genesis account %s: Storage key %s collides with the reserved asset-balance slot for asset %s", rec.Address, slot, assetID)
+			}
+			statedb.SetState(rec.Address, slot, common.BigToHash((*big.Int)(balance)))
+		}
+		count++
+		if count%genesisStreamBatchSize == 0 {
+			root, err = commitBatch()
+			if err != nil {
+				return genesis.Config, common.Hash{}, err
+			}
+			statedb, err = state.New(root, sdb, nil)
+			if err != nil {
+				return genesis.Config, common.Hash{}, err
+			}
+		}
+	}
+	root, err = commitBatch()
+	if err != nil {
+		return genesis.Config, common.Hash{}, err
+	}
+
+	block := types.NewBlock(genesisHeader(genesis, root), nil, nil, nil, trie.NewStackTrie(nil))
+
+	rawdb.WriteTd(db, block.Hash(), block.NumberU64(), block.Difficulty())
+	rawdb.WriteBlock(db, block)
+	rawdb.WriteReceipts(db, block.Hash(), block.NumberU64(), nil)
+	rawdb.WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+	rawdb.WriteHeadBlockHash(db, block.Hash())
+	rawdb.WriteHeadFastBlockHash(db, block.Hash())
+	rawdb.WriteHeadHeaderHash(db, block.Hash())
+	rawdb.WriteChainConfig(db, block.Hash(), genesis.Config)
+	return genesis.Config, block.Hash(), nil
+}
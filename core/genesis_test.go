@@ -27,7 +27,9 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/params/confp"
@@ -181,6 +183,114 @@ func TestSetupGenesis(t *testing.T) {
 				RewindToBlock: 1,
 			},
 		},
+		{
+			// Mirrors "incompatible config in DB" above, but the incompatibility
+			// is driven by the stored chain having already crossed its configured
+			// TerminalTotalDifficulty rather than by a block-numbered fork.
+			//
+			// Unlike the fork-based case, this test does not drive the chain
+			// forward through NewBlockChain/GenerateChain/bc.InsertChain with a
+			// beacon-wrapped engine (consensus/beacon.New) selecting PoS
+			// validation past the transition: the cumulative difficulty at
+			// which a generated chain first exceeds a given TTD depends on
+			// ethash's real difficulty-adjustment formula, which would have to
+			// be derived by actually running the generator rather than
+			// predicted by hand, and the resulting StoredBlock in wantErr below
+			// would be a guess rather than a verified value. Until that chain
+			// can be generated and its crossing point confirmed, this case
+			// writes the post-TTD chain segment directly to rawdb as canonical
+			// headers with chosen total difficulties (not derived from the
+			// headers' own Difficulty fields), so checkCompatibleTTD is
+			// exercised against on-disk state with a StoredBlock we can state
+			// exactly.
+			name: "incompatible TTD config in DB",
+			fn: func(db ethdb.Database) (ctypes.ChainConfigurator, common.Hash, error) {
+				oldttdcustomg := customg
+				oldttdcustomg.Config = &goethereum.ChainConfig{
+					HomesteadBlock:          big.NewInt(0),
+					TerminalTotalDifficulty: big.NewInt(300000),
+				}
+				newttdcustomg := customg
+				newttdcustomg.Config = &goethereum.ChainConfig{
+					HomesteadBlock: big.NewInt(0),
+					// The new config drops the merge transition entirely.
+				}
+
+				genesis := MustCommitGenesis(db, &oldttdcustomg)
+
+				// Hand-roll two descendant headers with known cumulative
+				// difficulty, so the block at which TTD is first exceeded
+				// is deterministic without depending on ethash's difficulty
+				// formula.
+				h1 := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Difficulty: big.NewInt(1)}
+				h2 := &types.Header{ParentHash: h1.Hash(), Number: big.NewInt(2), Difficulty: big.NewInt(1)}
+				rawdb.WriteHeader(db, h1)
+				rawdb.WriteTd(db, h1.Hash(), 1, big.NewInt(200000))
+				rawdb.WriteCanonicalHash(db, h1.Hash(), 1)
+				rawdb.WriteHeader(db, h2)
+				rawdb.WriteTd(db, h2.Hash(), 2, big.NewInt(400000))
+				rawdb.WriteCanonicalHash(db, h2.Hash(), 2)
+				rawdb.WriteHeadHeaderHash(db, h2.Hash())
+				rawdb.WriteHeaderNumber(db, h2.Hash(), 2)
+
+				// This should return a compatibility error.
+				return SetupGenesisBlock(db, trie.NewDatabase(db), &newttdcustomg)
+			},
+			wantHash:   customghash,
+			wantConfig: &goethereum.ChainConfig{HomesteadBlock: big.NewInt(0)},
+			wantErr: &confp.ConfigCompatError{
+				What:          "terminal total difficulty",
+				StoredBlock:   big.NewInt(2),
+				RewindToBlock: 1,
+			},
+		},
+		{
+			// A new config that *raises* the TTD is only compatible if the
+			// canonical chain's frozen, post-merge total difficulty still
+			// reaches the new threshold. Here the chain is frozen at TD
+			// 400000 (it stopped accumulating difficulty once it merged),
+			// and the new config raises the TTD to 1000000, which the chain
+			// never reaches. Naively comparing newTTD >= storedTTD would
+			// call this compatible; it isn't, since the chain would
+			// retroactively appear un-merged under the new config.
+			name: "incompatible raised TTD config in DB",
+			fn: func(db ethdb.Database) (ctypes.ChainConfigurator, common.Hash, error) {
+				oldttdcustomg := customg
+				oldttdcustomg.Config = &goethereum.ChainConfig{
+					HomesteadBlock:          big.NewInt(0),
+					TerminalTotalDifficulty: big.NewInt(300000),
+				}
+				newttdcustomg := customg
+				newttdcustomg.Config = &goethereum.ChainConfig{
+					HomesteadBlock:          big.NewInt(0),
+					TerminalTotalDifficulty: big.NewInt(1000000),
+				}
+
+				genesis := MustCommitGenesis(db, &oldttdcustomg)
+
+				h1 := &types.Header{ParentHash: genesis.Hash(), Number: big.NewInt(1), Difficulty: big.NewInt(1)}
+				h2 := &types.Header{ParentHash: h1.Hash(), Number: big.NewInt(2), Difficulty: big.NewInt(1)}
+				rawdb.WriteHeader(db, h1)
+				rawdb.WriteTd(db, h1.Hash(), 1, big.NewInt(200000))
+				rawdb.WriteCanonicalHash(db, h1.Hash(), 1)
+				rawdb.WriteHeader(db, h2)
+				rawdb.WriteTd(db, h2.Hash(), 2, big.NewInt(400000))
+				rawdb.WriteCanonicalHash(db, h2.Hash(), 2)
+				rawdb.WriteHeadHeaderHash(db, h2.Hash())
+				rawdb.WriteHeaderNumber(db, h2.Hash(), 2)
+
+				// This should return a compatibility error.
+				return SetupGenesisBlock(db, trie.NewDatabase(db), &newttdcustomg)
+			},
+			wantHash:   customghash,
+			wantConfig: &goethereum.ChainConfig{HomesteadBlock: big.NewInt(0), TerminalTotalDifficulty: big.NewInt(1000000)},
+			wantErr: &confp.ConfigCompatError{
+				What:          "terminal total difficulty",
+				StoredBlock:   big.NewInt(2),
+				NewBlock:      big.NewInt(1000000),
+				RewindToBlock: 1,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -416,6 +526,40 @@ func TestGenesis_Commit(t *testing.T) {
 	}
 }
 
+// TestGenesis_CommitPreimages checks that UsePreimages controls whether the
+// trie-key preimages for Alloc addresses and storage slots are persisted
+// alongside the genesis state.
+func TestGenesis_CommitPreimages(t *testing.T) {
+	addr := common.Address{1}
+	slot := common.Hash{1}
+	allocWithStorage := func() genesisT.GenesisAlloc {
+		return genesisT.GenesisAlloc{
+			addr: {Balance: big.NewInt(1), Storage: map[common.Hash]common.Hash{slot: {1}}},
+		}
+	}
+
+	// With UsePreimages disabled (the default), no preimages should be written.
+	db := rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, &genesisT.Genesis{Config: params.TestChainConfig, Alloc: allocWithStorage()})
+	if preimage := rawdb.ReadPreimage(db, crypto.Keccak256Hash(addr.Bytes())); preimage != nil {
+		t.Errorf("expected no address preimage to be written, got: %x", preimage)
+	}
+	if preimage := rawdb.ReadPreimage(db, crypto.Keccak256Hash(slot.Bytes())); preimage != nil {
+		t.Errorf("expected no storage-slot preimage to be written, got: %x", preimage)
+	}
+
+	// With UsePreimages enabled, both the address and storage-slot preimages
+	// should be resolvable from the database.
+	db = rawdb.NewMemoryDatabase()
+	MustCommitGenesis(db, &genesisT.Genesis{Config: params.TestChainConfig, Alloc: allocWithStorage(), UsePreimages: true})
+	if preimage := rawdb.ReadPreimage(db, crypto.Keccak256Hash(addr.Bytes())); !bytes.Equal(preimage, addr.Bytes()) {
+		t.Errorf("address preimage mismatch: want %x, got %x", addr.Bytes(), preimage)
+	}
+	if preimage := rawdb.ReadPreimage(db, crypto.Keccak256Hash(slot.Bytes())); !bytes.Equal(preimage, slot.Bytes()) {
+		t.Errorf("storage-slot preimage mismatch: want %x, got %x", slot.Bytes(), preimage)
+	}
+}
+
 func TestReadWriteGenesisAlloc(t *testing.T) {
 	var (
 		db    = rawdb.NewMemoryDatabase()
@@ -446,3 +590,211 @@ func TestReadWriteGenesisAlloc(t *testing.T) {
 		}
 	}
 }
+
+// TestDumpLoadGenesisAllocStreaming checks that an alloc committed to a
+// genesis, dumped via DumpGenesisAlloc, and reloaded via LoadGenesisAlloc
+// derives the same hash as the original, unstreamed allocation.
+func TestDumpLoadGenesisAllocStreaming(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	alloc := &genesisT.GenesisAlloc{
+		{1}: {Balance: big.NewInt(1), Storage: map[common.Hash]common.Hash{{1}: {1}}},
+		{2}: {Balance: big.NewInt(2), Code: []byte{0x60, 0x00}},
+	}
+	genesis := &genesisT.Genesis{Config: params.TestChainConfig, Alloc: *alloc, UsePreimages: true}
+	block := MustCommitGenesis(db, genesis)
+
+	var buf bytes.Buffer
+	if err := DumpGenesisAlloc(db, block.Root(), &buf); err != nil {
+		t.Fatalf("DumpGenesisAlloc failed: %v", err)
+	}
+
+	reloaded, err := LoadGenesisAlloc(&buf)
+	if err != nil {
+		t.Fatalf("LoadGenesisAlloc failed: %v", err)
+	}
+
+	wantHash, err := gaDeriveHash(alloc)
+	if err != nil {
+		t.Fatalf("gaDeriveHash(original) failed: %v", err)
+	}
+	gotHash, err := gaDeriveHash(&reloaded.Alloc)
+	if err != nil {
+		t.Fatalf("gaDeriveHash(reloaded) failed: %v", err)
+	}
+	if wantHash != gotHash {
+		t.Errorf("alloc hash mismatch after dump/reload: want %x, got %x", wantHash, gotHash)
+	}
+}
+
+// TestSetupGenesisBlockStreaming_Batches checks that SetupGenesisBlockStreaming
+// produces the same state root whether or not the input is split across
+// multiple genesisStreamBatchSize commits, and that it actually performs more
+// than one trie commit when the batch size is smaller than the number of
+// accounts in the stream.
+func TestSetupGenesisBlockStreaming_Batches(t *testing.T) {
+	const numAccounts = 25
+
+	alloc := make(genesisT.GenesisAlloc, numAccounts)
+	for i := 0; i < numAccounts; i++ {
+		addr := common.BigToAddress(big.NewInt(int64(i + 1)))
+		alloc[addr] = genesisT.GenesisAccount{Balance: big.NewInt(int64(i + 1))}
+	}
+	genesis := &genesisT.Genesis{Config: params.TestChainConfig, Alloc: alloc, UsePreimages: true}
+
+	// Baseline: commit the whole allocation in one go via the non-streaming path.
+	db := rawdb.NewMemoryDatabase()
+	wantBlock := MustCommitGenesis(db, genesis)
+
+	// Dump it back out as newline-delimited JSON to feed into the streaming path.
+	var buf bytes.Buffer
+	if err := DumpGenesisAlloc(db, wantBlock.Root(), &buf); err != nil {
+		t.Fatalf("DumpGenesisAlloc failed: %v", err)
+	}
+
+	origBatchSize := genesisStreamBatchSize
+	genesisStreamBatchSize = 10
+	defer func() { genesisStreamBatchSize = origBatchSize }()
+
+	var commits int
+	genesisStreamBatchCommitHook = func() { commits++ }
+	defer func() { genesisStreamBatchCommitHook = nil }()
+
+	streamDB := rawdb.NewMemoryDatabase()
+	_, gotHash, err := SetupGenesisBlockStreaming(streamDB, trie.NewDatabase(streamDB), genesis, &buf)
+	if err != nil {
+		t.Fatalf("SetupGenesisBlockStreaming failed: %v", err)
+	}
+	if gotHash != wantBlock.Hash() {
+		t.Errorf("streamed genesis hash mismatch: want %s, got %s", wantBlock.Hash(), gotHash)
+	}
+	// 25 accounts at a batch size of 10 commit twice mid-stream (at 10 and 20
+	// records) plus once more for the trailing partial batch: 3 commits. A
+	// regression to a single Commit() at the end would produce 1.
+	if wantCommits := 3; commits != wantCommits {
+		t.Errorf("commit count = %d, want %d (batching did not occur)", commits, wantCommits)
+	}
+}
+
+// TestReadWriteGenesisAlloc_MultiAsset extends TestReadWriteGenesisAlloc with
+// a mix of single-coin and multi-coin accounts, verifying that AssetBalances
+// round-trips through JSON alongside a plain Balance-only account.
+func TestReadWriteGenesisAlloc_MultiAsset(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	alloc := &genesisT.GenesisAlloc{
+		{1}: {Balance: big.NewInt(1), Storage: map[common.Hash]common.Hash{{1}: {1}}},
+		{2}: {
+			Balance: big.NewInt(2),
+			AssetBalances: map[common.Hash]*big.Int{
+				{0xa1}: big.NewInt(100),
+				{0xa2}: big.NewInt(200),
+			},
+		},
+	}
+	hash, err := gaDeriveHash(alloc)
+	if err != nil {
+		t.Fatalf("gaDeriveHash failed: %v", err)
+	}
+	if hash == (common.Hash{}) {
+		t.Fatal("gaDeriveHash returned the zero hash")
+	}
+
+	// The derived hash must actually be sensitive to AssetBalances, not just
+	// to Balance/Storage: stripping it from account {2} should change the
+	// committed state root.
+	withoutAssets := &genesisT.GenesisAlloc{
+		{1}: (*alloc)[common.Address{1}],
+		{2}: {Balance: big.NewInt(2)},
+	}
+	strippedHash, err := gaDeriveHash(withoutAssets)
+	if err != nil {
+		t.Fatalf("gaDeriveHash(withoutAssets) failed: %v", err)
+	}
+	if hash == strippedHash {
+		t.Fatal("gaDeriveHash is not sensitive to AssetBalances")
+	}
+
+	blob, _ := json.Marshal(alloc)
+	rawdb.WriteGenesisStateSpec(db, hash, blob)
+
+	var reload genesisT.GenesisAlloc
+	if err := reload.UnmarshalJSON(rawdb.ReadGenesisStateSpec(db, hash)); err != nil {
+		t.Fatalf("Failed to load genesis state %v", err)
+	}
+	if len(reload) != len(*alloc) {
+		t.Fatal("Unexpected genesis allocation")
+	}
+	for addr, account := range reload {
+		want, ok := (*alloc)[addr]
+		if !ok {
+			t.Fatal("Account is not found")
+		}
+		if !reflect.DeepEqual(want, account) {
+			t.Fatal("Unexpected account")
+		}
+	}
+}
+
+// TestDumpGenesisAlloc_MultiAssetPreimages checks that an account combining
+// AssetBalances with UsePreimages can be dumped via DumpGenesisAlloc and
+// reloaded via LoadGenesisAlloc without losing the AssetBalances/Storage
+// distinction: the derived asset-balance slots must round-trip back into
+// AssetBalances, not into Storage as opaque entries.
+func TestDumpGenesisAlloc_MultiAssetPreimages(t *testing.T) {
+	db := rawdb.NewMemoryDatabase()
+	addr := common.Address{1}
+	account := genesisT.GenesisAccount{
+		Balance: big.NewInt(1),
+		Storage: map[common.Hash]common.Hash{{1}: {1}},
+		AssetBalances: map[common.Hash]*big.Int{
+			{0xa1}: big.NewInt(100),
+			{0xa2}: big.NewInt(200),
+		},
+	}
+	genesis := &genesisT.Genesis{Config: params.TestChainConfig, Alloc: genesisT.GenesisAlloc{addr: account}, UsePreimages: true}
+	block := MustCommitGenesis(db, genesis)
+
+	var buf bytes.Buffer
+	if err := DumpGenesisAlloc(db, block.Root(), &buf); err != nil {
+		t.Fatalf("DumpGenesisAlloc failed: %v", err)
+	}
+
+	reloaded, err := LoadGenesisAlloc(&buf)
+	if err != nil {
+		t.Fatalf("LoadGenesisAlloc failed: %v", err)
+	}
+	got, ok := reloaded.Alloc[addr]
+	if !ok {
+		t.Fatalf("reloaded alloc is missing account %s", addr)
+	}
+	if !reflect.DeepEqual(got.Storage, account.Storage) {
+		t.Errorf("Storage mismatch after round trip: want %v, got %v", account.Storage, got.Storage)
+	}
+	if len(got.AssetBalances) != len(account.AssetBalances) {
+		t.Fatalf("AssetBalances count mismatch: want %d, got %d", len(account.AssetBalances), len(got.AssetBalances))
+	}
+	for assetID, want := range account.AssetBalances {
+		got, ok := got.AssetBalances[assetID]
+		if !ok || got.Cmp(want) != 0 {
+			t.Errorf("AssetBalances[%s]: want %v, got %v", assetID, want, got)
+		}
+	}
+}
+
+// TestFlushAlloc_AssetBalanceStorageCollision checks that flushAlloc rejects
+// a genesis account whose Storage map claims a key that collides with one of
+// its own AssetBalances' derived slots, rather than silently letting one
+// overwrite the other.
+func TestFlushAlloc_AssetBalanceStorageCollision(t *testing.T) {
+	assetID := common.Hash{0xa1}
+	slot := assetBalanceSlot(assetID)
+	alloc := genesisT.GenesisAlloc{
+		{1}: {
+			Balance:       big.NewInt(1),
+			Storage:       map[common.Hash]common.Hash{slot: {0xff}},
+			AssetBalances: map[common.Hash]*big.Int{assetID: big.NewInt(100)},
+		},
+	}
+	if _, err := flushAlloc(&alloc, rawdb.NewMemoryDatabase(), false); err == nil {
+		t.Fatal("expected an error for a Storage key colliding with an asset-balance slot, got nil")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package genesisT holds the data types used to describe a chain's genesis
+// specification, decoupled from any particular chain configuration schema.
+package genesisT
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/params/types/ctypes"
+)
+
+//go:generate gencodec -type Genesis -field-override genesisSpecMarshaling -out gen_genesis.go
+//go:generate gencodec -type GenesisAccount -field-override genesisAccountMarshaling -out gen_genesis_account.go
+
+// Genesis specifies the header fields, state of a genesis block. It also
+// defines hard fork switch-over blocks through the chain configuration.
+type Genesis struct {
+	Config     ctypes.ChainConfigurator `json:"config"`
+	Nonce      uint64                   `json:"nonce"`
+	Timestamp  uint64                   `json:"timestamp"`
+	ExtraData  []byte                   `json:"extraData"`
+	GasLimit   uint64                   `json:"gasLimit"   gencodec:"required"`
+	Difficulty *big.Int                 `json:"difficulty" gencodec:"required"`
+	Mixhash    common.Hash              `json:"mixHash"`
+	Coinbase   common.Address           `json:"coinbase"`
+	Alloc      GenesisAlloc             `json:"alloc"      gencodec:"required"`
+
+	// These fields are used for consensus tests. Please don't use them
+	// in actual genesis blocks.
+	Number     uint64      `json:"number"`
+	GasUsed    uint64      `json:"gasUsed"`
+	ParentHash common.Hash `json:"parentHash"`
+	BaseFee    *big.Int    `json:"baseFeePerGas"`
+
+	// UsePreimages, when set, instructs the genesis commit path to record
+	// the preimages of the trie keys derived from Alloc (account address
+	// hashes and storage-slot hashes) alongside the state, so that they can
+	// later be resolved for debug/archival RPCs such as debug_storageRangeAt.
+	// This field is not part of the genesis JSON schema; it is a runtime-only
+	// knob set by the node (e.g. via the --cache.preimages CLI flag).
+	UsePreimages bool `json:"-"`
+}
+
+// genesisSpecMarshaling is the field-override type consumed by gencodec (see
+// gen_genesis.go) to (de)serialize Genesis values with the hexutil/math
+// encodings real genesis JSON files use for their numeric and byte fields.
+type genesisSpecMarshaling struct {
+	Nonce      math.HexOrDecimal64
+	Timestamp  math.HexOrDecimal64
+	ExtraData  hexutil.Bytes
+	GasLimit   math.HexOrDecimal64
+	GasUsed    math.HexOrDecimal64
+	Number     math.HexOrDecimal64
+	Difficulty *math.HexOrDecimal256
+	BaseFee    *math.HexOrDecimal256
+	Alloc      map[common.UnprefixedAddress]GenesisAccount
+}
+
+// GenesisAlloc specifies the initial state that is part of the genesis block.
+type GenesisAlloc map[common.Address]GenesisAccount
+
+// GenesisAccount is an account in the state of the genesis block.
+type GenesisAccount struct {
+	Code       []byte                      `json:"code,omitempty"`
+	Storage    map[common.Hash]common.Hash `json:"storage,omitempty"`
+	Balance    *big.Int                    `json:"balance" gencodec:"required"`
+	Nonce      uint64                      `json:"nonce,omitempty"`
+	PrivateKey []byte                      `json:"secretKey,omitempty"` // for tests
+
+	// AssetBalances optionally seeds the account with balances in native
+	// assets other than the chain's primary one, keyed by asset id. Chains
+	// that want multiple native currencies at genesis (without deploying
+	// ERC-20 contracts) set these; accounts that only use Balance are
+	// unaffected and produce identical state to before this field existed.
+	AssetBalances map[common.Hash]*big.Int `json:"assetBalances,omitempty"`
+}
+
+// genesisAccountMarshaling is the field-override type consumed by gencodec
+// (see gen_genesis_account.go) to (de)serialize GenesisAccount values with
+// the hexutil encodings the genesis JSON schema expects.
+type genesisAccountMarshaling struct {
+	Code          hexutil.Bytes
+	Balance       *hexutil.Big
+	Nonce         hexutil.Uint64
+	Storage       map[storageJSON]storageJSON
+	PrivateKey    hexutil.Bytes
+	AssetBalances map[common.Hash]*hexutil.Big
+}
+
+// storageJSON represents a 256 bit byte array, but allows less than 256 bits
+// when unmarshaling from hex.
+type storageJSON common.Hash
+
+func (h *storageJSON) UnmarshalText(text []byte) error {
+	text = common.FromHex(string(text))
+	if len(text) > 32 {
+		return fmt.Errorf("too many bytes when unmarshaling storage key/value %q", text)
+	}
+	offset := 32 - len(text)
+	copy(h[offset:], text)
+	return nil
+}
+
+func (h storageJSON) MarshalText() ([]byte, error) {
+	return hexutil.Bytes(h[:]).MarshalText()
+}
+
+// UnmarshalJSON decodes a GenesisAlloc, accepting the "plain" mapping of
+// address to account used by genesis JSON files.
+func (ga *GenesisAlloc) UnmarshalJSON(data []byte) error {
+	m := make(map[common.UnprefixedAddress]GenesisAccount)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*ga = make(GenesisAlloc)
+	for addr, a := range m {
+		(*ga)[common.Address(addr)] = a
+	}
+	return nil
+}
+
+// GenesisMismatchError is raised when trying to overwrite an existing
+// genesis block with an incompatible one.
+type GenesisMismatchError struct {
+	Stored, New common.Hash
+}
+
+func (e *GenesisMismatchError) Error() string {
+	return fmt.Sprintf("database contains incompatible genesis (have %x, new %x)", e.Stored, e.New)
+}